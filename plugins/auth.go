@@ -0,0 +1,294 @@
+// Copyright 2016 Mesosphere, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dcos/dcos-metrics/producers"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// ErrUnauthorized is returned by makeMetricsRequest when the metrics
+// service responds 401, so callers can tell an expired token apart from
+// other request failures and refresh it.
+var ErrUnauthorized = errors.New("metrics request unauthorized")
+
+// tokenHolder is a thread-safe holder for a DC/OS auth token, refreshed
+// in the background as it nears expiry.
+type tokenHolder struct {
+	mu          sync.RWMutex
+	token       string
+	exp         time.Time
+	refreshStop chan struct{}
+}
+
+func (h *tokenHolder) Get() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.token
+}
+
+func (h *tokenHolder) Set(token string, exp time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.token = token
+	h.exp = exp
+}
+
+// replaceRefreshStop cancels the previously scheduled refresh (if any)
+// and returns a fresh stop channel for the caller's new schedule, so
+// logins triggered early (e.g. by a 401) don't leave the prior
+// scheduleTokenRefresh goroutine sleeping forever.
+func (h *tokenHolder) replaceRefreshStop() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.refreshStop != nil {
+		close(h.refreshStop)
+	}
+
+	stop := make(chan struct{})
+	h.refreshStop = stop
+
+	return stop
+}
+
+// usingServiceAccount reports whether the plugin was configured to log
+// in as a DC/OS service account rather than use a static --auth-token.
+func (p *Plugin) usingServiceAccount() bool {
+	return len(p.ServiceAccountUID) > 0 && len(p.PrivateKeyFile) > 0
+}
+
+// currentToken returns the token that should be used for the next
+// request: the live, auto-refreshed service-account token if one is
+// configured, or the static --auth-token otherwise.
+func (p *Plugin) currentToken() string {
+	if p.usingServiceAccount() {
+		return p.tokenHolder.Get()
+	}
+
+	return p.AuthToken
+}
+
+// loginServiceAccount signs a short-lived RS256 JWT with the
+// service-account private key, exchanges it for a DC/OS auth token at
+// /acs/api/v1/auth/login, and caches the result. It schedules its own
+// refresh at 80% of the token's lifetime.
+func (p *Plugin) loginServiceAccount() error {
+	keyBytes, err := ioutil.ReadFile(p.PrivateKeyFile)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return fmt.Errorf("no PEM data found in %s", p.PrivateKeyFile)
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	loginExp := time.Now().Add(5 * time.Minute)
+	loginToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"uid": p.ServiceAccountUID,
+		"exp": loginExp.Unix(),
+	})
+
+	signed, err := loginToken.SignedString(key)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"uid":   p.ServiceAccountUID,
+		"token": signed,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(p.IAMURL+"/acs/api/v1/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("service account login to %s returned status %d", p.IAMURL, resp.StatusCode)
+	}
+
+	var loginResp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
+		return err
+	}
+
+	exp, err := tokenExpiry(loginResp.Token)
+	if err != nil {
+		return err
+	}
+
+	p.tokenHolder.Set(loginResp.Token, exp)
+	p.Log.Infof("Refreshed DC/OS service account token, expires %s", exp)
+
+	stop := p.tokenHolder.replaceRefreshStop()
+	go p.scheduleTokenRefresh(exp, stop)
+
+	return nil
+}
+
+// scheduleTokenRefresh sleeps until 80% of the token's remaining
+// lifetime has elapsed, then refreshes it, unless stop is closed first
+// (because a newer login, e.g. one triggered early by a 401, already
+// scheduled its own refresh).
+func (p *Plugin) scheduleTokenRefresh(exp time.Time, stop <-chan struct{}) {
+	delay := time.Duration(float64(time.Until(exp)) * 0.8)
+	if delay < 0 {
+		delay = 0
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-stop:
+		return
+	case <-timer.C:
+	}
+
+	if err := p.loginServiceAccount(); err != nil {
+		p.Log.Errorf("Encountered error refreshing service account token, %s", err.Error())
+	}
+}
+
+// requestMetrics builds an authenticated GET to path on
+// MetricsHost:MetricsPort and makes the request, refreshing the
+// service-account token and retrying exactly once if the metrics
+// service responds 401.
+func (p *Plugin) requestMetrics(path string) (producers.MetricsMessage, error) {
+	doRequest := func() (producers.MetricsMessage, error) {
+		if len(p.currentToken()) == 0 {
+			return producers.MetricsMessage{}, errors.New("Auth token must be set, use --auth-token <token>")
+		}
+
+		request := &http.Request{
+			Method: "GET",
+			URL: &url.URL{
+				Scheme: p.MetricsProto,
+				Host:   net.JoinHostPort(p.MetricsHost, p.MetricsPort),
+				Path:   path,
+			},
+			Header: http.Header{
+				"Authorization": []string{fmt.Sprintf("token=%s", p.currentToken())},
+			},
+		}
+
+		return makeMetricsRequest(request)
+	}
+
+	mm, err := doRequest()
+	if err == ErrUnauthorized && p.usingServiceAccount() {
+		p.Log.Warn("Metrics request unauthorized, refreshing service account token and retrying once")
+
+		if refreshErr := p.loginServiceAccount(); refreshErr != nil {
+			return mm, refreshErr
+		}
+
+		return doRequest()
+	}
+
+	return mm, err
+}
+
+// listContainers requests the container discovery endpoint, refreshing
+// the service-account token and retrying exactly once on a 401.
+func (p *Plugin) listContainers() (*http.Response, error) {
+	doRequest := func() (*http.Response, error) {
+		if len(p.currentToken()) == 0 {
+			return nil, errors.New("Auth token must be set, use --auth-token <token>")
+		}
+
+		request := &http.Request{
+			Method: "GET",
+			URL: &url.URL{
+				Scheme: p.MetricsProto,
+				Host:   net.JoinHostPort(p.MetricsHost, p.MetricsPort),
+				Path:   "/system/v1/metrics/v0/containers",
+			},
+			Header: http.Header{
+				"Authorization": []string{fmt.Sprintf("token=%s", p.currentToken())},
+			},
+		}
+
+		client := &http.Client{}
+		resp, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, ErrUnauthorized
+		}
+
+		return resp, nil
+	}
+
+	resp, err := doRequest()
+	if err == ErrUnauthorized && p.usingServiceAccount() {
+		p.Log.Warn("Container discovery unauthorized, refreshing service account token and retrying once")
+
+		if refreshErr := p.loginServiceAccount(); refreshErr != nil {
+			return nil, refreshErr
+		}
+
+		return doRequest()
+	}
+
+	return resp, err
+}
+
+// tokenExpiry parses the exp claim out of a DC/OS JWT without verifying
+// its signature; the token was just issued by IAM, so we only need the
+// claim to schedule our own refresh.
+func tokenExpiry(token string) (time.Time, error) {
+	parser := &jwt.Parser{}
+	claims := jwt.MapClaims{}
+
+	if _, _, err := parser.ParseUnverified(token, claims); err != nil {
+		return time.Time{}, err
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, errors.New("token is missing an exp claim")
+	}
+
+	return time.Unix(int64(exp), 0), nil
+}
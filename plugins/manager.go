@@ -0,0 +1,435 @@
+// Copyright 2016 Mesosphere, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dcos/dcos-metrics/producers"
+	"github.com/urfave/cli"
+)
+
+// defaultManifestRegistryURL is the default base URL plugin manifests
+// are fetched from during Install, e.g.
+// https://dcos-metrics-plugins.mesosphere.com/<name>/<version>/manifest.json
+const defaultManifestRegistryURL = "https://dcos-metrics-plugins.mesosphere.com"
+
+// ConnectorInfo describes the current state of one named connector, as
+// returned by Backend.Inspect and Backend.List.
+type ConnectorInfo struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Enabled bool     `json:"enabled"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Manifest is the versioned plugin descriptor fetched during Install. It
+// declares the privileges a connector needs (network access, auth-token
+// scope, filesystem paths) so they can be surfaced to an operator before
+// the connector is activated.
+type Manifest struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	Privileges []string `json:"privileges"`
+}
+
+// InstallOptions configures Backend.Install.
+type InstallOptions struct {
+	Version string
+}
+
+// Backend is the plugin lifecycle contract a PluginManager drives,
+// modeled on the Docker plugin backend: plugins are listed, inspected,
+// installed, enabled/disabled, reconfigured and removed by name.
+type Backend interface {
+	List() ([]ConnectorInfo, error)
+	Inspect(name string) (*ConnectorInfo, error)
+	Install(name string, opts InstallOptions) error
+	Enable(name string) error
+	Disable(name string) error
+	Set(name string, args []string) error
+	Remove(name string) error
+}
+
+// PluginManager hosts multiple named connectors (graphite, statsd,
+// prometheus, datadog, ...) at once, in place of the single hard-wired
+// Plugin.ConnectorFunc. Enabled-plugin state is persisted under
+// ConfigDir so it survives restarts.
+type PluginManager struct {
+	ConfigDir  string
+	Log        *logrus.Entry
+	Backend    Backend
+	connectors map[string]func([]producers.MetricsMessage, *cli.Context) error
+}
+
+// NewManager returns a PluginManager backed by a JSON file under
+// p.PluginConfigDir, with the built-in connectors registered.
+func NewManager(p *Plugin) (*PluginManager, error) {
+	configDir := p.PluginConfigDir
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return nil, err
+	}
+
+	m := &PluginManager{
+		ConfigDir: configDir,
+		Log:       logrus.WithFields(logrus.Fields{"plugin": "manager"}),
+		Backend:   newFileBackend(filepath.Join(configDir, "plugins.json")),
+		connectors: map[string]func([]producers.MetricsMessage, *cli.Context) error{
+			"prometheus": p.PrometheusConnector,
+		},
+	}
+
+	return m, nil
+}
+
+// Commands returns the install/enable/disable/inspect/remove/set
+// lifecycle as cli subcommands, ready to be appended to a Plugin's
+// App.Commands.
+func (m *PluginManager) Commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "list",
+			Usage: "List installed connectors",
+			Action: func(c *cli.Context) error {
+				connectors, err := m.Backend.List()
+				if err != nil {
+					return err
+				}
+				for _, info := range connectors {
+					fmt.Fprintf(os.Stdout, "%s\tversion=%s\tenabled=%t\n", info.Name, info.Version, info.Enabled)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "Show the state of a single connector",
+			ArgsUsage: "<name>",
+			Action: func(c *cli.Context) error {
+				info, err := m.Backend.Inspect(c.Args().First())
+				if err != nil {
+					return err
+				}
+				out, err := json.MarshalIndent(info, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(os.Stdout, string(out))
+				return nil
+			},
+		},
+		{
+			Name:      "install",
+			Usage:     "Install a versioned connector",
+			ArgsUsage: "<name>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "version", Value: "latest"},
+			},
+			Action: func(c *cli.Context) error {
+				return m.Backend.Install(c.Args().First(), InstallOptions{Version: c.String("version")})
+			},
+		},
+		{
+			Name:      "enable",
+			Usage:     "Enable an installed connector",
+			ArgsUsage: "<name>",
+			Action: func(c *cli.Context) error {
+				return m.Backend.Enable(c.Args().First())
+			},
+		},
+		{
+			Name:      "disable",
+			Usage:     "Disable an installed connector",
+			ArgsUsage: "<name>",
+			Action: func(c *cli.Context) error {
+				return m.Backend.Disable(c.Args().First())
+			},
+		},
+		{
+			Name:      "set",
+			Usage:     "Set a connector's arguments",
+			ArgsUsage: "<name> [args...]",
+			Action: func(c *cli.Context) error {
+				return m.Backend.Set(c.Args().First(), c.Args().Tail())
+			},
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove an installed connector",
+			ArgsUsage: "<name>",
+			Action: func(c *cli.Context) error {
+				return m.Backend.Remove(c.Args().First())
+			},
+		},
+	}
+}
+
+// Dispatch fans a batch of metrics out to every enabled connector.
+func (m *PluginManager) Dispatch(metrics []producers.MetricsMessage, c *cli.Context) error {
+	connectors, err := m.Backend.List()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range connectors {
+		if !info.Enabled {
+			continue
+		}
+
+		connectorFunc, ok := m.connectors[info.Name]
+		if !ok {
+			m.Log.Warnf("No connector implementation registered for enabled plugin %s, skipping", info.Name)
+			continue
+		}
+
+		if err := connectorFunc(metrics, c); err != nil {
+			m.Log.Errorf("Connector %s returned an error, %s", info.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+/*** fileBackend: a Backend implementation persisting state as JSON ***/
+
+type fileBackend struct {
+	path        string
+	registryURL string
+	mu          sync.Mutex
+
+	// fetchManifest and acceptPrivileges are overridable so Install's
+	// fetch/prompt flow doesn't have to hit the network or a terminal
+	// in tests; they default to fetchManifest and promptAcceptPrivileges.
+	fetchManifest    func(registryURL, name, version string) (*Manifest, error)
+	acceptPrivileges func(*Manifest) bool
+}
+
+func newFileBackend(path string) *fileBackend {
+	return &fileBackend{
+		path:             path,
+		registryURL:      defaultManifestRegistryURL,
+		fetchManifest:    fetchManifest,
+		acceptPrivileges: promptAcceptPrivileges,
+	}
+}
+
+// fetchManifest retrieves the versioned plugin descriptor for name from
+// the manifest registry, declaring the privileges (network access,
+// auth-token scope, filesystem paths) the connector requires.
+func fetchManifest(registryURL, name, version string) (*Manifest, error) {
+	manifestURL := fmt.Sprintf("%s/%s/%s/manifest.json", strings.TrimRight(registryURL, "/"), name, version)
+
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching manifest for %s@%s returned status %d", name, version, resp.StatusCode)
+	}
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(resp.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest for %s@%s: %s", name, version, err.Error())
+	}
+
+	return manifest, nil
+}
+
+// promptAcceptPrivileges prints the privileges a manifest declares and
+// asks the operator to accept them before the connector is installed.
+func promptAcceptPrivileges(manifest *Manifest) bool {
+	fmt.Fprintf(os.Stdout, "Plugin %s@%s requires the following privileges:\n", manifest.Name, manifest.Version)
+	for _, privilege := range manifest.Privileges {
+		fmt.Fprintf(os.Stdout, "  - %s\n", privilege)
+	}
+	fmt.Fprint(os.Stdout, "Accept and install? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func (b *fileBackend) read() (map[string]ConnectorInfo, error) {
+	state := map[string]ConnectorInfo{}
+
+	data, err := ioutil.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (b *fileBackend) write(state map[string]ConnectorInfo) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(b.path, data, 0644)
+}
+
+func (b *fileBackend) List() ([]ConnectorInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+
+	connectors := make([]ConnectorInfo, 0, len(state))
+	for _, info := range state {
+		connectors = append(connectors, info)
+	}
+
+	return connectors, nil
+}
+
+func (b *fileBackend) Inspect(name string) (*ConnectorInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := b.read()
+	if err != nil {
+		return nil, err
+	}
+
+	info, ok := state[name]
+	if !ok {
+		return nil, fmt.Errorf("connector %s is not installed", name)
+	}
+
+	return &info, nil
+}
+
+func (b *fileBackend) Install(name string, opts InstallOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := b.read()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := state[name]; ok {
+		return fmt.Errorf("connector %s is already installed", name)
+	}
+
+	manifest, err := b.fetchManifest(b.registryURL, name, opts.Version)
+	if err != nil {
+		return fmt.Errorf("fetching manifest for %s: %s", name, err.Error())
+	}
+
+	if !b.acceptPrivileges(manifest) {
+		return fmt.Errorf("privileges for %s were not accepted, not installing", name)
+	}
+
+	state[name] = ConnectorInfo{
+		Name:    name,
+		Version: manifest.Version,
+		Enabled: false,
+	}
+
+	return b.write(state)
+}
+
+func (b *fileBackend) Enable(name string) error {
+	return b.setEnabled(name, true)
+}
+
+func (b *fileBackend) Disable(name string) error {
+	return b.setEnabled(name, false)
+}
+
+func (b *fileBackend) setEnabled(name string, enabled bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := b.read()
+	if err != nil {
+		return err
+	}
+
+	info, ok := state[name]
+	if !ok {
+		return fmt.Errorf("connector %s is not installed", name)
+	}
+
+	info.Enabled = enabled
+	state[name] = info
+
+	return b.write(state)
+}
+
+func (b *fileBackend) Set(name string, args []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := b.read()
+	if err != nil {
+		return err
+	}
+
+	info, ok := state[name]
+	if !ok {
+		return fmt.Errorf("connector %s is not installed", name)
+	}
+
+	info.Args = args
+	state[name] = info
+
+	return b.write(state)
+}
+
+func (b *fileBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, err := b.read()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := state[name]; !ok {
+		return fmt.Errorf("connector %s is not installed", name)
+	}
+
+	delete(state, name)
+
+	return b.write(state)
+}
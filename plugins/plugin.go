@@ -19,11 +19,9 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"time"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/dcos/dcos-go/dcos"
@@ -32,17 +30,52 @@ import (
 )
 
 type Plugin struct {
-	App             *cli.App
-	Name            string
-	Endpoints       []string
-	Role            string
-	PollingInterval int
-	MetricsPort     string
-	MetricsProto    string
-	MetricsHost     string
-	AuthToken       string
-	Log             *logrus.Entry
-	ConnectorFunc   func([]producers.MetricsMessage, *cli.Context) error
+	App                 *cli.App
+	Name                string
+	Endpoints           []string
+	Role                string
+	PollingInterval     int
+	MetricsPort         string
+	MetricsProto        string
+	MetricsHost         string
+	AuthToken           string
+	ServiceAccountUID   string
+	PrivateKeyFile      string
+	IAMURL              string
+	UseMetricsSock      bool
+	MetricsSock         string
+	PluginConfigDir     string
+	PrometheusListen    string
+	PrometheusNamespace string
+	DiscoveryInterval   int
+	Log                 *logrus.Entry
+	ConnectorFunc       func([]producers.MetricsMessage, *cli.Context) error
+
+	// Manager, when set, fans each poll tick's metrics out to every
+	// enabled connector it hosts instead of the single ConnectorFunc.
+	Manager *PluginManager
+
+	// stats tracks the supervisor's own health so it can be surfaced to
+	// operators (see supervisor.go).
+	stats selfStats
+
+	// tokenHolder caches the live service-account token (see auth.go).
+	tokenHolder tokenHolder
+
+	// promMu guards promLatest, the most recently polled metrics served
+	// by the embedded Prometheus endpoint (see prometheus.go).
+	promMu     sync.RWMutex
+	promLatest []producers.MetricsMessage
+}
+
+// dispatch sends a batch of metrics to the Manager's enabled connectors
+// if one is configured, falling back to the single ConnectorFunc.
+func (p *Plugin) dispatch(metrics []producers.MetricsMessage, c *cli.Context) error {
+	if p.Manager != nil {
+		return p.Manager.Dispatch(metrics, c)
+	}
+
+	return p.ConnectorFunc(metrics, c)
 }
 
 var VERSION = "UNSET"
@@ -51,13 +84,18 @@ var VERSION = "UNSET"
 // metrics will need
 func New(options ...Option) (*Plugin, error) {
 	newPlugin := &Plugin{
-		Name:            "default",
-		Role:            "",
-		PollingInterval: 10,
-		MetricsProto:    "http",
-		MetricsHost:     "localhost",
-		MetricsPort:     "61001",
-		AuthToken:       "",
+		Name:              "default",
+		Role:              "",
+		PollingInterval:   10,
+		MetricsProto:      "http",
+		MetricsHost:       "localhost",
+		MetricsPort:       "61001",
+		AuthToken:         "",
+		MetricsSock:       "/run/dcos/metrics.sock",
+		PluginConfigDir:   "/var/lib/dcos-metrics/plugins",
+		PrometheusListen:  "",
+		DiscoveryInterval: 60,
+		IAMURL:            "https://leader.mesos",
 	}
 
 	newPlugin.App = cli.NewApp()
@@ -91,15 +129,68 @@ func New(options ...Option) (*Plugin, error) {
 		cli.StringFlag{
 			Name:        "auth-token",
 			Value:       newPlugin.AuthToken,
-			Usage:       "Valid authentication token for DC/OS services",
+			Usage:       "Valid authentication token for DC/OS services. Ignored if --service-account-uid and --private-key-file are both set",
 			Destination: &newPlugin.AuthToken,
 		},
+		cli.StringFlag{
+			Name:        "service-account-uid",
+			Value:       newPlugin.ServiceAccountUID,
+			Usage:       "DC/OS service account uid to log in as instead of using a static --auth-token",
+			Destination: &newPlugin.ServiceAccountUID,
+		},
+		cli.StringFlag{
+			Name:        "private-key-file",
+			Value:       newPlugin.PrivateKeyFile,
+			Usage:       "Path to the service account's PEM-encoded RSA private key",
+			Destination: &newPlugin.PrivateKeyFile,
+		},
+		cli.StringFlag{
+			Name:        "iam-url",
+			Value:       newPlugin.IAMURL,
+			Usage:       "Base URL of the DC/OS IAM service used to log the service account in",
+			Destination: &newPlugin.IAMURL,
+		},
 		cli.StringFlag{
 			Name:        "dcos-role",
 			Value:       newPlugin.Role,
 			Usage:       "DC/OS role, either master or agent",
 			Destination: &newPlugin.Role,
 		},
+		cli.BoolFlag{
+			Name:        "metrics-sock-enabled",
+			Usage:       "Receive pushed metrics over a Unix socket instead of polling over HTTP",
+			Destination: &newPlugin.UseMetricsSock,
+		},
+		cli.StringFlag{
+			Name:        "metrics-sock",
+			Value:       newPlugin.MetricsSock,
+			Usage:       "Unix socket path to receive pushed metrics on when --metrics-sock-enabled is set",
+			Destination: &newPlugin.MetricsSock,
+		},
+		cli.StringFlag{
+			Name:        "prometheus-listen",
+			Value:       newPlugin.PrometheusListen,
+			Usage:       "Listen address (host:port) to serve Prometheus metrics on, e.g. :9100. Leave empty to disable",
+			Destination: &newPlugin.PrometheusListen,
+		},
+		cli.StringFlag{
+			Name:        "prometheus-namespace",
+			Value:       newPlugin.PrometheusNamespace,
+			Usage:       "Namespace prefix applied to every metric exposed on the Prometheus endpoint",
+			Destination: &newPlugin.PrometheusNamespace,
+		},
+		cli.StringFlag{
+			Name:        "plugin-config-dir",
+			Value:       newPlugin.PluginConfigDir,
+			Usage:       "Directory to persist enabled-connector state for the plugin manager",
+			Destination: &newPlugin.PluginConfigDir,
+		},
+		cli.IntFlag{
+			Name:        "discovery-interval",
+			Value:       newPlugin.DiscoveryInterval,
+			Usage:       "How often, in seconds, to refresh the discovered container endpoints",
+			Destination: &newPlugin.DiscoveryInterval,
+		},
 	}
 
 	for _, o := range options {
@@ -110,68 +201,50 @@ func New(options ...Option) (*Plugin, error) {
 
 	newPlugin.Log = logrus.WithFields(logrus.Fields{"plugin": newPlugin.Name})
 
-	return newPlugin, nil
-}
-
-func (p *Plugin) StartPlugin() error {
-	p.App.Action = func(c *cli.Context) error {
-		for {
-			metrics, err := p.Metrics()
-			if err != nil {
-				return err
-			}
-
-			if err := p.ConnectorFunc(metrics, c); err != nil {
-				return err
-			}
-
-			p.Log.Infof("Polling complete, sleeping for %d seconds", p.PollingInterval)
-			time.Sleep(time.Duration(p.PollingInterval) * time.Second)
+	if newPlugin.usingServiceAccount() {
+		if err := newPlugin.loginServiceAccount(); err != nil {
+			return newPlugin, err
 		}
-
-		return nil
 	}
 
-	return p.App.Run(os.Args)
+	return newPlugin, nil
 }
 
-func (p *Plugin) Metrics() ([]producers.MetricsMessage, error) {
-	p.Log.Info("Getting metrics from metrics service")
-	metricsMessages := []producers.MetricsMessage{}
-
-	if err := p.setEndpoints(); err != nil {
-		p.Log.Fatal(err)
+// UsePluginManager opts a plugin into being a multi-connector host: it
+// constructs a PluginManager backed by PluginConfigDir and appends its
+// lifecycle subcommands to App.Commands. Call it before StartPlugin.
+// Plugins that only ever use a single ConnectorFunc have no reason to
+// call this, and so never touch PluginConfigDir at all.
+func (p *Plugin) UsePluginManager() error {
+	manager, err := NewManager(p)
+	if err != nil {
+		return err
 	}
 
-	for _, path := range p.Endpoints {
-		metricsURL := url.URL{
-			Scheme: p.MetricsProto,
-			Host:   net.JoinHostPort(p.MetricsHost, p.MetricsPort),
-			Path:   path,
-		}
+	p.Manager = manager
+	p.App.Commands = append(p.App.Commands, manager.Commands()...)
 
-		if len(p.AuthToken) == 0 {
-			return metricsMessages, errors.New("Auth token must be set, use --auth-token <token>")
-		}
+	return nil
+}
 
-		request := &http.Request{
-			Method: "GET",
-			URL:    &metricsURL,
-			Header: http.Header{
-				"Authorization": []string{fmt.Sprintf("token=%s", p.AuthToken)},
-			},
+func (p *Plugin) StartPlugin() error {
+	p.App.Action = func(c *cli.Context) error {
+		if len(p.PrometheusListen) > 0 {
+			go func() {
+				if err := p.servePrometheus(); err != nil {
+					p.Log.Fatal(err)
+				}
+			}()
 		}
 
-		metricMessage, err := makeMetricsRequest(request)
-		if err != nil {
-			return metricsMessages, err
+		if p.UseMetricsSock {
+			return p.receiveFromSocket(c)
 		}
 
-		metricsMessages = append(metricsMessages, metricMessage)
-		p.Log.Infof("Received data from metrics service endpoint %s, success!", request.URL.Path)
+		return p.runSupervisor(c)
 	}
 
-	return metricsMessages, nil
+	return p.App.Run(os.Args)
 }
 
 // SetEndpoints uses the role passed as a flag to generate the metrics endpoints
@@ -191,22 +264,7 @@ func (p *Plugin) setEndpoints() error {
 		}
 
 		containers := []string{}
-		metricsURL := url.URL{
-			Scheme: p.MetricsProto,
-			Host:   net.JoinHostPort(p.MetricsHost, p.MetricsPort),
-			Path:   "/system/v1/metrics/v0/containers",
-		}
-
-		request := &http.Request{
-			Method: "GET",
-			URL:    &metricsURL,
-			Header: http.Header{
-				"Authorization": []string{fmt.Sprintf("token=%s", p.AuthToken)},
-			},
-		}
-
-		client := &http.Client{}
-		resp, err := client.Do(request)
+		resp, err := p.listContainers()
 		if err != nil {
 			return err
 		}
@@ -247,6 +305,14 @@ func makeMetricsRequest(request *http.Request) (producers.MetricsMessage, error)
 		return mm, err
 	}
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return mm, ErrUnauthorized
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return mm, fmt.Errorf("metrics endpoint %s returned status %d", request.URL.Path, resp.StatusCode)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		l.Errorf("Encountered error reading response body, %s", err.Error())
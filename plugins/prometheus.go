@@ -0,0 +1,143 @@
+// Copyright 2016 Mesosphere, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/dcos/dcos-metrics/producers"
+	"github.com/urfave/cli"
+)
+
+// PrometheusConnector is a ConnectorFunc that stashes every polled batch
+// of metrics on the Plugin so the embedded /metrics HTTP server (started
+// by StartPlugin when --prometheus-listen is set) can expose them in
+// the Prometheus text exposition format.
+func (p *Plugin) PrometheusConnector(metrics []producers.MetricsMessage, c *cli.Context) error {
+	p.promMu.Lock()
+	p.promLatest = metrics
+	p.promMu.Unlock()
+
+	return nil
+}
+
+// servePrometheus starts the embedded HTTP server that exposes the
+// latest polled metrics at /metrics in Prometheus text exposition
+// format. It blocks, so it must be run in its own goroutine.
+func (p *Plugin) servePrometheus() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.prometheusHandler)
+
+	p.Log.Infof("Serving Prometheus metrics on %s/metrics", p.PrometheusListen)
+	return http.ListenAndServe(p.PrometheusListen, mux)
+}
+
+func (p *Plugin) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	p.promMu.RLock()
+	defer p.promMu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePrometheusMetrics(w, p.PrometheusNamespace, p.promLatest)
+}
+
+// promSample is one family member: a label set and its value.
+type promSample struct {
+	labels string
+	value  interface{}
+}
+
+// writePrometheusMetrics renders every MetricsMessage's datapoints as
+// Prometheus text exposition format. Datapoints are grouped by their
+// sanitized metric name across all messages first, so that each
+// family's # HELP/# TYPE pair is emitted exactly once, immediately
+// followed by all of that family's samples, as the format requires.
+// Without this grouping, the same metric name reported by multiple
+// containers would otherwise produce repeated, non-adjacent HELP/TYPE
+// lines that a Prometheus scraper rejects.
+func writePrometheusMetrics(w http.ResponseWriter, namespace string, messages []producers.MetricsMessage) {
+	names := []string{}
+	samples := map[string][]promSample{}
+
+	for _, mm := range messages {
+		labels := dimensionsToLabels(mm.Dimensions)
+
+		for _, dp := range mm.Datapoints {
+			name := prometheusName(namespace, dp.Name)
+
+			if _, ok := samples[name]; !ok {
+				names = append(names, name)
+			}
+			samples[name] = append(samples[name], promSample{labels: labels, value: dp.Value})
+		}
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, name)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+
+		for _, s := range samples[name] {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, s.labels, s.value)
+		}
+	}
+}
+
+// prometheusName sanitizes a dotted dcos-metrics name (e.g.
+// "network.in.packets") into a Prometheus-safe identifier
+// (e.g. "dcos_network_in_packets") with the configured namespace prefix.
+func prometheusName(namespace, name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+
+	if len(namespace) == 0 {
+		return sanitized
+	}
+
+	return namespace + "_" + sanitized
+}
+
+// dimensionsToLabels renders a MetricsMessage's dimensions as a sorted,
+// comma-separated list of Prometheus label="value" pairs.
+func dimensionsToLabels(dimensions producers.Dimensions) string {
+	raw := map[string]string{
+		"cluster_id":   dimensions.ClusterID,
+		"container_id": dimensions.ContainerID,
+		"executor_id":  dimensions.ExecutorID,
+		"mesos_id":     dimensions.MesosID,
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k, v := range raw {
+		if len(v) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, raw[k]))
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Mesosphere, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dcos/dcos-metrics/producers"
+	"github.com/urfave/cli"
+)
+
+// receiveFromSocket listens on p.MetricsSock for newline-delimited JSON
+// producers.MetricsMessage records pushed by the DC/OS metrics agent, and
+// hands the batch accumulated since the last tick to dispatch (the
+// Manager's enabled connectors if set, else ConnectorFunc) every
+// PollingInterval seconds. It removes any requirement for an auth token,
+// since the agent pushes to a socket co-located with the plugin rather
+// than the plugin pulling over authenticated HTTP.
+func (p *Plugin) receiveFromSocket(c *cli.Context) error {
+	if err := os.RemoveAll(p.MetricsSock); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("unix", p.MetricsSock)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	p.Log.Infof("Listening for pushed metrics on socket %s", p.MetricsSock)
+
+	var mu sync.Mutex
+	batch := []producers.MetricsMessage{}
+
+	go func() {
+		backoff := time.Second
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				p.Log.Errorf("Encountered error accepting socket connection, backing off %s: %s", backoff, err.Error())
+				time.Sleep(backoff)
+
+				backoff *= 2
+				if backoff > backoffCap {
+					backoff = backoffCap
+				}
+				continue
+			}
+
+			backoff = time.Second
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					mm := producers.MetricsMessage{}
+					if err := json.Unmarshal(scanner.Bytes(), &mm); err != nil {
+						p.Log.Errorf("Encountered error parsing pushed metrics, %s", err.Error())
+						continue
+					}
+
+					mu.Lock()
+					batch = append(batch, mm)
+					mu.Unlock()
+				}
+
+				if err := scanner.Err(); err != nil {
+					p.Log.Errorf("Encountered error reading from socket, %s", err.Error())
+				}
+			}(conn)
+		}
+	}()
+
+	for {
+		time.Sleep(time.Duration(p.PollingInterval) * time.Second)
+
+		mu.Lock()
+		drained := batch
+		batch = []producers.MetricsMessage{}
+		mu.Unlock()
+
+		if len(drained) == 0 {
+			continue
+		}
+
+		if err := p.dispatch(drained, c); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Mesosphere, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dcos/dcos-metrics/producers"
+	"github.com/urfave/cli"
+)
+
+// resultsBuffer caps how many scraped batches can queue up for the
+// dispatcher before the oldest is dropped in favor of fresher data.
+const resultsBuffer = 64
+
+// backoffCap is the maximum delay a worker will wait between retries of
+// a failing endpoint.
+const backoffCap = 2 * time.Minute
+
+// selfStats are the supervisor's self-metrics, updated with atomic
+// operations since workers run concurrently.
+type selfStats struct {
+	scrapeFailures  int64
+	droppedBatches  int64
+	lastScrapeNanos int64
+}
+
+// runSupervisor discovers endpoints on its own goroutine, scrapes each
+// one concurrently on its own schedule with jittered polling and
+// exponential backoff on errors, and fans results into dispatch through
+// a bounded buffer that drops the oldest batch on overflow rather than
+// blocking the workers.
+func (p *Plugin) runSupervisor(c *cli.Context) error {
+	results := make(chan producers.MetricsMessage, resultsBuffer)
+	workers := map[string]chan struct{}{}
+	var mu sync.Mutex
+
+	startWorker := func(path string) {
+		stop := make(chan struct{})
+		workers[path] = stop
+		go p.scrapeWorker(path, results, stop)
+	}
+
+	mu.Lock()
+	if err := p.setEndpoints(); err != nil {
+		mu.Unlock()
+		return err
+	}
+	for _, path := range p.Endpoints {
+		startWorker(path)
+	}
+	mu.Unlock()
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(p.DiscoveryInterval) * time.Second)
+
+			if err := p.setEndpoints(); err != nil {
+				p.Log.Errorf("Encountered error refreshing discovered endpoints, %s", err.Error())
+				continue
+			}
+
+			mu.Lock()
+			current := map[string]bool{}
+			for _, path := range p.Endpoints {
+				current[path] = true
+				if _, ok := workers[path]; !ok {
+					p.Log.Infof("Starting worker for newly discovered endpoint %s", path)
+					startWorker(path)
+				}
+			}
+			for path, stop := range workers {
+				if !current[path] {
+					p.Log.Infof("Stopping worker for endpoint %s, no longer discovered", path)
+					close(stop)
+					delete(workers, path)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	batch := []producers.MetricsMessage{}
+	ticker := time.NewTicker(time.Duration(p.PollingInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case mm := <-results:
+			if len(batch) >= resultsBuffer {
+				batch = batch[1:]
+				atomic.AddInt64(&p.stats.droppedBatches, 1)
+				p.Log.Warnf("Dropped oldest buffered batch, %d dropped so far", atomic.LoadInt64(&p.stats.droppedBatches))
+			}
+			batch = append(batch, mm)
+
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+
+			flushed := batch
+			batch = []producers.MetricsMessage{}
+
+			p.Log.Infof("Dispatching %d batches (last scrape took %s, %d scrape failures, %d batches dropped)",
+				len(flushed),
+				time.Duration(atomic.LoadInt64(&p.stats.lastScrapeNanos)),
+				atomic.LoadInt64(&p.stats.scrapeFailures),
+				atomic.LoadInt64(&p.stats.droppedBatches))
+
+			if err := p.dispatch(flushed, c); err != nil {
+				p.Log.Errorf("Encountered error dispatching metrics, %s", err.Error())
+			}
+		}
+	}
+}
+
+// scrapeWorker repeatedly scrapes a single endpoint on PollingInterval
+// with jitter, backing off exponentially (capped at backoffCap) on
+// errors instead of exiting, until stop is closed.
+func (p *Plugin) scrapeWorker(path string, results chan<- producers.MetricsMessage, stop <-chan struct{}) {
+	backoff := time.Second
+
+	for {
+		interval := time.Duration(p.PollingInterval) * time.Second
+
+		var jitter time.Duration
+		if interval > 1 {
+			jitter = time.Duration(rand.Int63n(int64(interval) / 2))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval + jitter):
+		}
+
+		start := time.Now()
+		mm, err := p.scrapeEndpoint(path)
+		atomic.StoreInt64(&p.stats.lastScrapeNanos, time.Since(start).Nanoseconds())
+
+		if err != nil {
+			atomic.AddInt64(&p.stats.scrapeFailures, 1)
+			p.Log.Errorf("Encountered error scraping %s, backing off %s: %s", path, backoff, err.Error())
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > backoffCap {
+				backoff = backoffCap
+			}
+			continue
+		}
+
+		backoff = time.Second
+
+		select {
+		case results <- mm:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// scrapeEndpoint performs a single authenticated scrape of path against
+// MetricsHost:MetricsPort.
+func (p *Plugin) scrapeEndpoint(path string) (producers.MetricsMessage, error) {
+	return p.requestMetrics(path)
+}